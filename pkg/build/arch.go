@@ -0,0 +1,119 @@
+// Copyright 2018 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package build
+
+import "fmt"
+
+// imageBuilder captures everything that differs between target architectures
+// when building a kernel and assembling it, together with a userspace root
+// filesystem, into a bootable image.
+type imageBuilder interface {
+	// kernelTarget is the make target that produces the kernel image
+	// (e.g. "bzImage", "Image.gz", "zImage").
+	kernelTarget() string
+	// kernelImagePath is the path of the built kernel image relative to kernelDir.
+	kernelImagePath() string
+	// compileEnv returns extra "NAME=VALUE" environment variables (ARCH=,
+	// CROSS_COMPILE=, ...) that must be passed to make for this target.
+	compileEnv(compiler string) []string
+	// rootfsEnv returns extra SYZ_* environment variables passed to
+	// createImageScript that tell it how to assemble a rootfs for this arch
+	// (debian arch name, whether it's foreign and needs qemu-user, etc).
+	rootfsEnv() []string
+}
+
+// getImageBuilder returns the imageBuilder for the given target, or an error
+// if the target is not supported.
+func getImageBuilder(targetOS, targetArch string) (imageBuilder, error) {
+	if targetOS != "linux" {
+		return nil, fmt.Errorf("unsupported os/arch: %v/%v", targetOS, targetArch)
+	}
+	switch targetArch {
+	case "amd64":
+		return linuxAmd64{}, nil
+	case "arm64":
+		return linuxArm64{}, nil
+	case "arm":
+		return linuxArm{}, nil
+	case "ppc64le":
+		return linuxPPC64LE{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported os/arch: %v/%v", targetOS, targetArch)
+	}
+}
+
+// linuxAmd64 builds native linux/amd64 kernels and images, the only target
+// that does not need cross-compilation or a foreign rootfs.
+type linuxAmd64 struct{}
+
+func (linuxAmd64) kernelTarget() string    { return "bzImage" }
+func (linuxAmd64) kernelImagePath() string { return "arch/x86/boot/bzImage" }
+
+func (linuxAmd64) compileEnv(compiler string) []string {
+	return []string{"CC=" + compiler}
+}
+
+func (linuxAmd64) rootfsEnv() []string {
+	return []string{
+		"SYZ_ARCH=amd64",
+		"SYZ_DEBIAN_ARCH=amd64",
+	}
+}
+
+// linuxArm64 cross-builds linux/arm64 kernels and images from an x86 host.
+type linuxArm64 struct{}
+
+func (linuxArm64) kernelTarget() string    { return "Image.gz" }
+func (linuxArm64) kernelImagePath() string { return "arch/arm64/boot/Image.gz" }
+
+func (linuxArm64) compileEnv(compiler string) []string {
+	return []string{"ARCH=arm64", "CROSS_COMPILE=aarch64-linux-gnu-", "CC=" + compiler}
+}
+
+func (linuxArm64) rootfsEnv() []string {
+	return []string{
+		"SYZ_ARCH=arm64",
+		"SYZ_DEBIAN_ARCH=arm64",
+		"SYZ_FOREIGN_ARCH=1",
+		"SYZ_QEMU_STATIC=qemu-aarch64-static",
+	}
+}
+
+// linuxArm cross-builds linux/arm kernels and images from an x86 host.
+type linuxArm struct{}
+
+func (linuxArm) kernelTarget() string    { return "zImage" }
+func (linuxArm) kernelImagePath() string { return "arch/arm/boot/zImage" }
+
+func (linuxArm) compileEnv(compiler string) []string {
+	return []string{"ARCH=arm", "CROSS_COMPILE=arm-linux-gnueabihf-", "CC=" + compiler}
+}
+
+func (linuxArm) rootfsEnv() []string {
+	return []string{
+		"SYZ_ARCH=arm",
+		"SYZ_DEBIAN_ARCH=armhf",
+		"SYZ_FOREIGN_ARCH=1",
+		"SYZ_QEMU_STATIC=qemu-arm-static",
+	}
+}
+
+// linuxPPC64LE cross-builds linux/ppc64le kernels and images from an x86 host.
+type linuxPPC64LE struct{}
+
+func (linuxPPC64LE) kernelTarget() string    { return "zImage.epapr" }
+func (linuxPPC64LE) kernelImagePath() string { return "arch/powerpc/boot/zImage.epapr" }
+
+func (linuxPPC64LE) compileEnv(compiler string) []string {
+	return []string{"ARCH=powerpc", "CROSS_COMPILE=powerpc64le-linux-gnu-", "CC=" + compiler}
+}
+
+func (linuxPPC64LE) rootfsEnv() []string {
+	return []string{
+		"SYZ_ARCH=ppc64le",
+		"SYZ_DEBIAN_ARCH=ppc64el",
+		"SYZ_FOREIGN_ARCH=1",
+		"SYZ_QEMU_STATIC=qemu-ppc64le-static",
+	}
+}
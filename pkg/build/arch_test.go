@@ -0,0 +1,114 @@
+// Copyright 2018 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package build
+
+import "testing"
+
+func TestGetImageBuilder(t *testing.T) {
+	tests := []struct {
+		name            string
+		targetOS        string
+		targetArch      string
+		wantErr         bool
+		wantKernelTgt   string
+		wantKernelPath  string
+		wantForeignArch bool
+	}{
+		{
+			name:           "amd64",
+			targetOS:       "linux",
+			targetArch:     "amd64",
+			wantKernelTgt:  "bzImage",
+			wantKernelPath: "arch/x86/boot/bzImage",
+		},
+		{
+			name:            "arm64",
+			targetOS:        "linux",
+			targetArch:      "arm64",
+			wantKernelTgt:   "Image.gz",
+			wantKernelPath:  "arch/arm64/boot/Image.gz",
+			wantForeignArch: true,
+		},
+		{
+			name:            "arm",
+			targetOS:        "linux",
+			targetArch:      "arm",
+			wantKernelTgt:   "zImage",
+			wantKernelPath:  "arch/arm/boot/zImage",
+			wantForeignArch: true,
+		},
+		{
+			name:            "ppc64le",
+			targetOS:        "linux",
+			targetArch:      "ppc64le",
+			wantKernelTgt:   "zImage.epapr",
+			wantKernelPath:  "arch/powerpc/boot/zImage.epapr",
+			wantForeignArch: true,
+		},
+		{
+			name:       "unsupported arch",
+			targetOS:   "linux",
+			targetArch: "mips",
+			wantErr:    true,
+		},
+		{
+			name:       "unsupported os",
+			targetOS:   "darwin",
+			targetArch: "amd64",
+			wantErr:    true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			builder, err := getImageBuilder(test.targetOS, test.targetArch)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got builder %#v, want an error", builder)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := builder.kernelTarget(); got != test.wantKernelTgt {
+				t.Errorf("kernelTarget() = %q, want %q", got, test.wantKernelTgt)
+			}
+			if got := builder.kernelImagePath(); got != test.wantKernelPath {
+				t.Errorf("kernelImagePath() = %q, want %q", got, test.wantKernelPath)
+			}
+			env := envMap(builder.rootfsEnv())
+			if env["SYZ_ARCH"] != test.targetArch {
+				t.Errorf("rootfsEnv()[SYZ_ARCH] = %q, want %q", env["SYZ_ARCH"], test.targetArch)
+			}
+			_, foreign := env["SYZ_FOREIGN_ARCH"]
+			if foreign != test.wantForeignArch {
+				t.Errorf("rootfsEnv() foreign arch = %v, want %v", foreign, test.wantForeignArch)
+			}
+			if foreign {
+				if env["SYZ_QEMU_STATIC"] == "" {
+					t.Errorf("rootfsEnv() is foreign but has no SYZ_QEMU_STATIC")
+				}
+			}
+			compileEnv := envMap(builder.compileEnv("gcc"))
+			if compileEnv["CC"] != "gcc" {
+				t.Errorf("compileEnv(\"gcc\")[CC] = %q, want %q", compileEnv["CC"], "gcc")
+			}
+		})
+	}
+}
+
+// envMap turns a slice of "NAME=VALUE" strings, as returned by compileEnv/rootfsEnv,
+// into a map for easy lookups in tests.
+func envMap(env []string) map[string]string {
+	m := make(map[string]string)
+	for _, kv := range env {
+		for i := 0; i < len(kv); i++ {
+			if kv[i] == '=' {
+				m[kv[:i]] = kv[i+1:]
+				break
+			}
+		}
+	}
+	return m
+}
@@ -0,0 +1,188 @@
+// Copyright 2018 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package build
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+
+	"github.com/google/syzkaller/pkg/osutil"
+)
+
+// BuildErrorType classifies a BuildError so that dashboard consumers can group
+// identical root causes across many kernel revisions without parsing prose.
+type BuildErrorType int
+
+const (
+	UnknownError BuildErrorType = iota
+	CompileError
+	LinkError
+	ConfigError
+	OutOfMemoryError
+	DiskFullError
+	ToolchainMissingError
+)
+
+func (t BuildErrorType) String() string {
+	switch t {
+	case CompileError:
+		return "compile error"
+	case LinkError:
+		return "link error"
+	case ConfigError:
+		return "config error"
+	case OutOfMemoryError:
+		return "out of memory"
+	case DiskFullError:
+		return "disk full"
+	case ToolchainMissingError:
+		return "toolchain missing"
+	default:
+		return "unknown error"
+	}
+}
+
+// BuildError is a structured diagnosis of a kernel build failure, extracted
+// from the raw build log by extractRootCause.
+type BuildError struct {
+	*osutil.VerboseError
+	// Type classifies the failure (compile error, link error, OOM, ...).
+	Type BuildErrorType
+	// File and Line point at the offending source location (e.g. "net/core/dev.c", 123).
+	// Both are empty/0 if the failure could not be attributed to a single file.
+	File string
+	Line int
+	// Target is the failing make target reconstructed from the output
+	// (e.g. "net/core/dev.o"), empty if it could not be determined.
+	Target string
+	// Report is the full diagnostic block: the matched error/warning line plus
+	// any "In file included from" and "note:" context lines around it, and the
+	// CC/LD invocation that produced it, if present in the log.
+	Report string
+}
+
+func (err *BuildError) Error() string {
+	if err.Report != "" {
+		return err.Report
+	}
+	return err.VerboseError.Error()
+}
+
+type buildFailureCause struct {
+	pattern []byte
+	re      *regexp.Regexp
+	typ     BuildErrorType
+	weak    bool
+}
+
+func (c buildFailureCause) match(line []byte) bool {
+	if c.re != nil {
+		return c.re.Match(line)
+	}
+	return bytes.Contains(line, c.pattern)
+}
+
+// ldErrorRE matches an actual binutils/lld linker invocation ("ld: ..." or
+// ".../ld: ..."), not any line that merely contains the 4 bytes "ld: "
+// (e.g. "Build: ..." or "World: ...").
+var ldErrorRE = regexp.MustCompile(`(^|/)ld(\.(bfd|gold|lld))?: `)
+
+// oomKilledRE matches the kernel/job-control signatures of an out-of-memory kill,
+// not just any line containing the word "Killed".
+var oomKilledRE = regexp.MustCompile(`^\s*Killed\s*$|[Oo]ut of memory: [Kk]ill process|invoked oom-killer`)
+
+var buildFailureCauses = []buildFailureCause{
+	{pattern: []byte(": error: "), typ: CompileError},
+	{pattern: []byte(": fatal error: "), typ: CompileError},
+	{pattern: []byte(": undefined reference to"), typ: LinkError},
+	{pattern: []byte("undefined symbol"), typ: LinkError},
+	{pattern: []byte("multiple definition of"), typ: LinkError},
+	{re: ldErrorRE, typ: LinkError},
+	{pattern: []byte("ld.lld:"), typ: LinkError},
+	{pattern: []byte("ERROR: modpost:"), typ: LinkError},
+	{pattern: []byte("WARNING: modpost:"), typ: ConfigError, weak: true},
+	{pattern: []byte("No space left on device"), typ: DiskFullError},
+	{re: oomKilledRE, typ: OutOfMemoryError, weak: true},
+	{pattern: []byte(": not found"), typ: ToolchainMissingError, weak: true},
+	{weak: true, pattern: []byte(": final link failed: ")},
+	{weak: true, pattern: []byte("collect2: error: ")},
+}
+
+var (
+	fileLineRE     = regexp.MustCompile(`^([^\s:]+\.[ch]):(\d+):`)
+	ccInvocationRE = regexp.MustCompile(`^\s*(CC|LD|AR|AS)\s+\S+\s*$`)
+	includedFromRE = regexp.MustCompile(`In file included from |^\s*from `)
+	noteRE         = regexp.MustCompile(`note: `)
+	targetFailedRE = regexp.MustCompile(`recipe for target '([^']+)' failed`)
+)
+
+// extractRootCause scans a failed build's output for a known failure pattern and,
+// if found, returns a *BuildError describing it; otherwise the original error is
+// returned unchanged.
+func extractRootCause(err error) error {
+	verr, ok := err.(*osutil.VerboseError)
+	if !ok {
+		return err
+	}
+	lines := bytes.Split(verr.Output, []byte{'\n'})
+	causeIdx := -1
+	be := &BuildError{VerboseError: verr, Type: UnknownError}
+	for i, line := range lines {
+		for _, cause := range buildFailureCauses {
+			if cause.weak && causeIdx != -1 {
+				continue
+			}
+			if cause.match(line) {
+				causeIdx = i
+				be.Type = cause.typ
+				break
+			}
+		}
+	}
+	if causeIdx == -1 {
+		return verr
+	}
+	be.Report = string(extractContext(lines, causeIdx))
+	if m := fileLineRE.FindSubmatch(bytes.TrimSpace(lines[causeIdx])); m != nil {
+		be.File = string(m[1])
+		be.Line, _ = strconv.Atoi(string(m[2]))
+	}
+	be.Target = findFailingTarget(lines, causeIdx)
+	verr.Title = string(bytes.TrimSpace(lines[causeIdx]))
+	return be
+}
+
+// extractContext expands the single matched line at idx into the full diagnostic
+// block: any preceding "In file included from"/"from" chain, the CC/LD invocation
+// that produced it, and any following "note:" lines.
+func extractContext(lines [][]byte, idx int) []byte {
+	start := idx
+	for start > 0 && includedFromRE.Match(lines[start-1]) {
+		start--
+	}
+	if start > 0 && ccInvocationRE.Match(lines[start-1]) {
+		start--
+	}
+	end := idx
+	for end+1 < len(lines) && noteRE.Match(lines[end+1]) {
+		end++
+	}
+	return bytes.Join(lines[start:end+1], []byte{'\n'})
+}
+
+// findFailingTarget looks a few lines past the matched cause for a
+// "recipe for target '...' failed" line and returns the target name.
+func findFailingTarget(lines [][]byte, idx int) string {
+	limit := idx + 20
+	if limit > len(lines) {
+		limit = len(lines)
+	}
+	for i := idx; i < limit; i++ {
+		if m := targetFailedRE.FindSubmatch(lines[i]); m != nil {
+			return string(m[1])
+		}
+	}
+	return ""
+}
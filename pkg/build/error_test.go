@@ -0,0 +1,131 @@
+// Copyright 2018 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package build
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/syzkaller/pkg/osutil"
+)
+
+func TestExtractRootCause(t *testing.T) {
+	tests := []struct {
+		name       string
+		output     string
+		wantType   BuildErrorType
+		wantFile   string
+		wantLine   int
+		wantTarget string
+		wantReport string
+		wantNil    bool
+	}{
+		{
+			name: "compile error with file:line",
+			output: strings.Join([]string{
+				"  CC      net/core/dev.o",
+				"net/core/dev.c:123:4: error: implicit declaration of function 'foo'",
+				"make[2]: *** [net/core/dev.o] Error 1",
+			}, "\n"),
+			wantType:   CompileError,
+			wantFile:   "net/core/dev.c",
+			wantLine:   123,
+			wantReport: "  CC      net/core/dev.o\nnet/core/dev.c:123:4: error: implicit declaration of function 'foo'",
+		},
+		{
+			name: "compile error with included-from and note context",
+			output: strings.Join([]string{
+				"In file included from net/core/dev.c:10:0,",
+				"                 from net/core/dev.h:5:",
+				"include/linux/skbuff.h:42:2: error: too many arguments to function",
+				"include/linux/skbuff.h:30:6: note: declared here",
+			}, "\n"),
+			wantType: CompileError,
+			wantFile: "include/linux/skbuff.h",
+			wantLine: 42,
+			wantReport: strings.Join([]string{
+				"In file included from net/core/dev.c:10:0,",
+				"                 from net/core/dev.h:5:",
+				"include/linux/skbuff.h:42:2: error: too many arguments to function",
+				"include/linux/skbuff.h:30:6: note: declared here",
+			}, "\n"),
+		},
+		{
+			name:       "real ld invocation is classified as a link error",
+			output:     "/usr/bin/ld: cannot find -lfoo",
+			wantType:   LinkError,
+			wantReport: "/usr/bin/ld: cannot find -lfoo",
+		},
+		{
+			name:    "a bare word ending in ld: is not mistaken for the linker",
+			output:  "World: done\nBuild: ok",
+			wantNil: true,
+		},
+		{
+			name: "recipe for target failure reconstructs the make target",
+			output: strings.Join([]string{
+				"net/core/dev.c:5:1: error: expected ';' before '}' token",
+				"make[1]: *** [net/core/dev.o] Error 1",
+				"Makefile:123: recipe for target 'net/core/dev.o' failed",
+			}, "\n"),
+			wantType:   CompileError,
+			wantFile:   "net/core/dev.c",
+			wantLine:   5,
+			wantTarget: "net/core/dev.o",
+		},
+		{
+			name:       "bare Killed line is classified as OOM",
+			output:     "make[2]: *** [net/core/dev.o]\nKilled",
+			wantType:   OutOfMemoryError,
+			wantReport: "Killed",
+		},
+		{
+			name: "weak OOM pattern does not override an earlier strong match",
+			output: strings.Join([]string{
+				"net/core/dev.c:5:1: error: expected ';' before '}' token",
+				"Killed",
+			}, "\n"),
+			wantType:   CompileError,
+			wantFile:   "net/core/dev.c",
+			wantLine:   5,
+			wantReport: "net/core/dev.c:5:1: error: expected ';' before '}' token",
+		},
+		{
+			name:    "no known pattern leaves the error untouched",
+			output:  "make: nothing to be done for 'all'",
+			wantNil: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verr := &osutil.VerboseError{Title: "build failed", Output: []byte(test.output)}
+			res := extractRootCause(verr)
+			be, ok := res.(*BuildError)
+			if test.wantNil {
+				if ok {
+					t.Fatalf("got *BuildError %+v, want the original error unchanged", be)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("got %T, want *BuildError", res)
+			}
+			if be.Type != test.wantType {
+				t.Errorf("Type = %v, want %v", be.Type, test.wantType)
+			}
+			if be.File != test.wantFile {
+				t.Errorf("File = %q, want %q", be.File, test.wantFile)
+			}
+			if be.Line != test.wantLine {
+				t.Errorf("Line = %v, want %v", be.Line, test.wantLine)
+			}
+			if be.Target != test.wantTarget {
+				t.Errorf("Target = %q, want %q", be.Target, test.wantTarget)
+			}
+			if test.wantReport != "" && be.Report != test.wantReport {
+				t.Errorf("Report = %q, want %q", be.Report, test.wantReport)
+			}
+		})
+	}
+}
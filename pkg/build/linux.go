@@ -10,7 +10,6 @@
 package build
 
 import (
-	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -22,7 +21,11 @@ import (
 	"github.com/google/syzkaller/pkg/osutil"
 )
 
-func Build(dir, compiler string, config []byte) error {
+func Build(targetArch, dir, compiler string, config []byte) error {
+	builder, err := getImageBuilder("linux", targetArch)
+	if err != nil {
+		return err
+	}
 	configFile := filepath.Join(dir, ".config")
 	if err := osutil.WriteFile(configFile, config); err != nil {
 		return fmt.Errorf("failed to write config file: %v", err)
@@ -30,10 +33,11 @@ func Build(dir, compiler string, config []byte) error {
 	if err := osutil.SandboxChown(configFile); err != nil {
 		return err
 	}
+	env := builder.compileEnv(compiler)
 	// One would expect olddefconfig here, but olddefconfig is not present in v3.6 and below.
 	// oldconfig is the same as olddefconfig if stdin is not set.
 	// Note: passing in compiler is important since 4.17 (at the very least it's noted in the config).
-	cmd := osutil.Command("make", "oldconfig", "CC="+compiler)
+	cmd := osutil.Command("make", append([]string{"oldconfig"}, env...)...)
 	if err := osutil.Sandbox(cmd, true, true); err != nil {
 		return err
 	}
@@ -41,9 +45,9 @@ func Build(dir, compiler string, config []byte) error {
 	if _, err := osutil.Run(10*time.Minute, cmd); err != nil {
 		return err
 	}
-	// We build only bzImage as we currently don't use modules.
+	// We build only the kernel image as we currently don't use modules.
 	cpu := strconv.Itoa(runtime.NumCPU())
-	cmd = osutil.Command("make", "bzImage", "-j", cpu, "CC="+compiler)
+	cmd = osutil.Command("make", append([]string{builder.kernelTarget(), "-j", cpu}, env...)...)
 	if err := osutil.Sandbox(cmd, true, true); err != nil {
 		return err
 	}
@@ -73,11 +77,19 @@ func Clean(dir string) error {
 // Produces image and root ssh key in the specified files.
 func CreateImage(targetOS, targetArch, vmType, kernelDir, userspaceDir, cmdlineFile, sysctlFile,
 	image, sshkey string) error {
-	if targetOS != "linux" || targetArch != "amd64" {
-		return fmt.Errorf("only linux/amd64 is supported")
+	builder, err := getImageBuilder(targetOS, targetArch)
+	if err != nil {
+		return err
+	}
+	if vmType == "iso" {
+		if targetArch != "amd64" {
+			return fmt.Errorf("iso images are only supported for linux/amd64")
+		}
+		kernelImage := filepath.Join(kernelDir, filepath.FromSlash(builder.kernelImagePath()))
+		return CreateISOImage(kernelImage, userspaceDir, cmdlineFile, sysctlFile, image, sshkey)
 	}
 	if vmType != "qemu" && vmType != "gce" {
-		return fmt.Errorf("images can be built only for qemu/gce machines")
+		return fmt.Errorf("images can be built only for qemu/gce/iso machines")
 	}
 	tempDir, err := ioutil.TempDir("", "syz-build")
 	if err != nil {
@@ -88,10 +100,11 @@ func CreateImage(targetOS, targetArch, vmType, kernelDir, userspaceDir, cmdlineF
 	if err := osutil.WriteExecFile(scriptFile, []byte(createImageScript)); err != nil {
 		return fmt.Errorf("failed to write script file: %v", err)
 	}
-	bzImage := filepath.Join(kernelDir, filepath.FromSlash("arch/x86/boot/bzImage"))
-	cmd := osutil.Command(scriptFile, userspaceDir, bzImage)
+	kernelImage := filepath.Join(kernelDir, filepath.FromSlash(builder.kernelImagePath()))
+	cmd := osutil.Command(scriptFile, userspaceDir, kernelImage)
 	cmd.Dir = tempDir
 	cmd.Env = append([]string{}, os.Environ()...)
+	cmd.Env = append(cmd.Env, builder.rootfsEnv()...)
 	cmd.Env = append(cmd.Env,
 		"SYZ_VM_TYPE="+vmType,
 		"SYZ_CMDLINE_FILE="+osutil.Abs(cmdlineFile),
@@ -113,38 +126,235 @@ func CreateImage(targetOS, targetArch, vmType, kernelDir, userspaceDir, cmdlineF
 	return nil
 }
 
-func extractRootCause(err error) error {
-	verr, ok := err.(*osutil.VerboseError)
-	if !ok {
-		return err
-	}
-	var cause []byte
-	for _, line := range bytes.Split(verr.Output, []byte{'\n'}) {
-		for _, pattern := range buildFailureCauses {
-			if pattern.weak && cause != nil {
-				continue
-			}
-			if bytes.Contains(line, pattern.pattern) {
-				cause = line
-				break
-			}
+// CreateISOImage creates a hybrid BIOS+EFI bootable ISO9660 image that boots kernelImage
+// with a root filesystem derived from userspaceDir.
+// If cmdlineFile is not empty, contents of the file are appended to the kernel command line.
+// If sysctlFile is not empty, contents of the file are appended to the rootfs /etc/sysctl.conf.
+// Unlike CreateImage, the resulting image can be booted directly on bare-metal or in
+// hypervisors that only accept CD-ROM/ISO media rather than raw disk images.
+// Produces image and root ssh key in the specified files; the key's public half is installed
+// into the rootfs's /root/.ssh/authorized_keys so the returned key can actually log in.
+func CreateISOImage(kernelImage, userspaceDir, cmdlineFile, sysctlFile, image, sshkey string) error {
+	tempDir, err := ioutil.TempDir("", "syz-build-iso")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+	isoRoot := filepath.Join(tempDir, "isoroot")
+	grubDir := filepath.Join(isoRoot, "boot", "grub")
+	if err := os.MkdirAll(grubDir, 0755); err != nil {
+		return fmt.Errorf("failed to create iso root: %v", err)
+	}
+	if err := osutil.CopyFile(kernelImage, filepath.Join(isoRoot, "vmlinuz")); err != nil {
+		return fmt.Errorf("failed to copy kernel image: %v", err)
+	}
+	rootfsDir := filepath.Join(tempDir, "rootfs")
+	cmd := osutil.Command("cp", "-a", userspaceDir, rootfsDir)
+	if _, err := osutil.Run(10*time.Minute, cmd); err != nil {
+		return fmt.Errorf("failed to stage rootfs: %v", err)
+	}
+	keyFile := filepath.Join(tempDir, "key")
+	cmd = osutil.Command("ssh-keygen", "-t", "rsa", "-b", "2048", "-N", "", "-C", "", "-f", keyFile)
+	if _, err := osutil.Run(time.Minute, cmd); err != nil {
+		return fmt.Errorf("ssh-keygen failed: %v", err)
+	}
+	if err := installAuthorizedKey(rootfsDir, keyFile+".pub"); err != nil {
+		return fmt.Errorf("failed to install ssh key into rootfs: %v", err)
+	}
+	if sysctlFile != "" {
+		if err := appendSysctl(rootfsDir, sysctlFile); err != nil {
+			return fmt.Errorf("failed to apply sysctl file: %v", err)
 		}
 	}
-	if cause != nil {
-		verr.Title = string(cause)
+	initrd := filepath.Join(isoRoot, "initrd")
+	if err := createInitrd(tempDir, rootfsDir, initrd); err != nil {
+		return fmt.Errorf("failed to create initrd: %v", err)
+	}
+	cmdline := "root=/dev/sr0 ro"
+	if cmdlineFile != "" {
+		bytes, err := ioutil.ReadFile(cmdlineFile)
+		if err != nil {
+			return fmt.Errorf("failed to read cmdline file: %v", err)
+		}
+		cmdline += " " + string(bytes)
+	}
+	grubCfg := fmt.Sprintf(grubCfgTemplate, cmdline)
+	if err := osutil.WriteFile(filepath.Join(grubDir, "grub.cfg"), []byte(grubCfg)); err != nil {
+		return fmt.Errorf("failed to write grub.cfg: %v", err)
+	}
+	// Legacy BIOS boots via a grub core image installed as the eltorito boot image and
+	// as the ISO's hybrid MBR; EFI boots via a FAT ESP image holding a second, EFI-format
+	// core image at the well-known EFI/BOOT/BOOTX64.EFI path.
+	coreImgBIOS := filepath.Join(grubDir, "core.img")
+	cmd = osutil.Command("grub-mkstandalone",
+		"--format=i386-pc-eltorito",
+		"--output="+coreImgBIOS,
+		"--install-modules=linux normal iso9660 biosdisk memdisk search tar ls",
+		"--modules=linux normal iso9660 biosdisk memdisk search tar ls",
+		"--locales=",
+		"--fonts=",
+		"boot/grub/grub.cfg="+filepath.Join(grubDir, "grub.cfg"))
+	cmd.Dir = tempDir
+	if _, err := osutil.Run(10*time.Minute, cmd); err != nil {
+		return fmt.Errorf("grub-mkstandalone (BIOS) failed: %v", err)
+	}
+	coreImgEFI := filepath.Join(tempDir, "bootx64.efi")
+	cmd = osutil.Command("grub-mkstandalone",
+		"--format=x86_64-efi",
+		"--output="+coreImgEFI,
+		"--locales=",
+		"--fonts=",
+		"boot/grub/grub.cfg="+filepath.Join(grubDir, "grub.cfg"))
+	cmd.Dir = tempDir
+	if _, err := osutil.Run(10*time.Minute, cmd); err != nil {
+		return fmt.Errorf("grub-mkstandalone (EFI) failed: %v", err)
+	}
+	espImg := filepath.Join(isoRoot, "EFI", "efiboot.img")
+	if err := os.MkdirAll(filepath.Dir(espImg), 0755); err != nil {
+		return fmt.Errorf("failed to create ESP dir: %v", err)
+	}
+	if err := createESPImage(espImg, coreImgEFI); err != nil {
+		return fmt.Errorf("failed to create ESP image: %v", err)
+	}
+	isoFile := filepath.Join(tempDir, "image.iso")
+	cmd = osutil.Command("xorriso",
+		"-as", "mkisofs",
+		"-iso-level", "3",
+		"-full-iso9660-filenames",
+		"-volid", "SYZKALLER",
+		"-eltorito-boot", "boot/grub/core.img",
+		"-no-emul-boot",
+		"-boot-load-size", "4",
+		"-boot-info-table",
+		"--grub2-boot-info",
+		"--grub2-mbr", coreImgBIOS,
+		"-eltorito-alt-boot",
+		"-e", "EFI/efiboot.img",
+		"-no-emul-boot",
+		"-isohybrid-gpt-basdat",
+		"-output", isoFile,
+		isoRoot)
+	cmd.Dir = tempDir
+	if _, err := osutil.Run(10*time.Minute, cmd); err != nil {
+		return fmt.Errorf("xorriso failed: %v", err)
+	}
+	// Note: we use CopyFile instead of Rename because src and dst can be on different filesystems.
+	if err := osutil.CopyFile(isoFile, image); err != nil {
+		return err
+	}
+	if err := osutil.CopyFile(keyFile, sshkey); err != nil {
+		return err
+	}
+	if err := os.Chmod(sshkey, 0600); err != nil {
+		return err
+	}
+	return nil
+}
+
+// createESPImage builds a small FAT EFI System Partition image at espImg holding
+// efiBoot as the default bootloader, at the well-known EFI/BOOT/BOOTX64.EFI path
+// firmware looks for when booting removable media.
+func createESPImage(espImg, efiBoot string) error {
+	cmd := osutil.Command("dd", "if=/dev/zero", "of="+espImg, "bs=1M", "count=4")
+	if _, err := osutil.Run(time.Minute, cmd); err != nil {
+		return err
+	}
+	cmd = osutil.Command("mkfs.vfat", espImg)
+	if _, err := osutil.Run(time.Minute, cmd); err != nil {
+		return err
+	}
+	cmd = osutil.Command("mmd", "-i", espImg, "::EFI", "::EFI/BOOT")
+	if _, err := osutil.Run(time.Minute, cmd); err != nil {
+		return err
+	}
+	cmd = osutil.Command("mcopy", "-i", espImg, efiBoot, "::EFI/BOOT/BOOTX64.EFI")
+	if _, err := osutil.Run(time.Minute, cmd); err != nil {
+		return err
 	}
-	return verr
+	return nil
 }
 
-type buildFailureCause struct {
-	pattern []byte
-	weak    bool
+// installAuthorizedKey installs pubKeyFile as the root user's sole authorized key
+// in the rootfs staged at rootfsDir.
+func installAuthorizedKey(rootfsDir, pubKeyFile string) error {
+	pubKey, err := ioutil.ReadFile(pubKeyFile)
+	if err != nil {
+		return err
+	}
+	sshDir := filepath.Join(rootfsDir, "root", ".ssh")
+	if err := os.MkdirAll(sshDir, 0700); err != nil {
+		return err
+	}
+	authorizedKeys := filepath.Join(sshDir, "authorized_keys")
+	if err := osutil.WriteFile(authorizedKeys, pubKey); err != nil {
+		return err
+	}
+	return os.Chmod(authorizedKeys, 0600)
+}
+
+// appendSysctl appends the contents of sysctlFile to /etc/sysctl.conf in the
+// rootfs staged at rootfsDir.
+func appendSysctl(rootfsDir, sysctlFile string) error {
+	contents, err := ioutil.ReadFile(sysctlFile)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(rootfsDir, "etc", "sysctl.conf"),
+		os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(contents)
+	return err
 }
 
-var buildFailureCauses = [...]buildFailureCause{
-	{pattern: []byte(": error: ")},
-	{pattern: []byte(": fatal error: ")},
-	{pattern: []byte(": undefined reference to")},
-	{weak: true, pattern: []byte(": final link failed: ")},
-	{weak: true, pattern: []byte("collect2: error: ")},
+// createInitrd builds a minimal cpio/gzip initrd from userspaceDir at the given path.
+func createInitrd(tempDir, userspaceDir, initrd string) error {
+	f, err := os.Create(initrd)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cmd1 := osutil.Command("find", ".", "-print0")
+	cmd1.Dir = userspaceDir
+	cmd2 := osutil.Command("cpio", "--null", "-o", "-H", "newc")
+	cmd2.Dir = userspaceDir
+	pipe, err := cmd1.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd2.Stdin = pipe
+	gzip := osutil.Command("gzip", "-9")
+	gzip.Stdin, err = cmd2.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	gzip.Stdout = f
+	if err := cmd1.Start(); err != nil {
+		return err
+	}
+	if err := cmd2.Start(); err != nil {
+		return err
+	}
+	if err := gzip.Start(); err != nil {
+		return err
+	}
+	if err := cmd1.Wait(); err != nil {
+		return err
+	}
+	if err := cmd2.Wait(); err != nil {
+		return err
+	}
+	return gzip.Wait()
+}
+
+const grubCfgTemplate = `set timeout=0
+set default=0
+
+menuentry "syzkaller" {
+	insmod iso9660
+	linux /vmlinuz %s
+	initrd /initrd
 }
+`